@@ -0,0 +1,131 @@
+package chain
+
+import (
+	"image"
+	"math"
+	"strings"
+)
+
+const blurHashCharacters = "0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz#$%*+,-.:;=?@[]^_{|}~"
+
+// EncodeBlurHash implements the BlurHash encoding described at
+// https://github.com/woltapp/blurhash: the image is decomposed into
+// xComponents x yComponents DCT-like coefficients in linear-sRGB space; the
+// DC term is packed into four base83 digits and each AC term is quantized
+// into a base83 digit pair, all behind a size flag and a max-AC flag.
+func EncodeBlurHash(img image.Image, xComponents, yComponents int) string {
+	bounds := img.Bounds()
+	width, height := bounds.Dx(), bounds.Dy()
+
+	factors := make([][3]float64, 0, xComponents*yComponents)
+	for cy := 0; cy < yComponents; cy++ {
+		for cx := 0; cx < xComponents; cx++ {
+			normalisation := 2.0
+			if cx == 0 && cy == 0 {
+				normalisation = 1.0
+			}
+			var r, g, b float64
+			for y := 0; y < height; y++ {
+				for x := 0; x < width; x++ {
+					basis := normalisation *
+						math.Cos(math.Pi*float64(cx)*float64(x)/float64(width)) *
+						math.Cos(math.Pi*float64(cy)*float64(y)/float64(height))
+					pr, pg, pb, _ := img.At(bounds.Min.X+x, bounds.Min.Y+y).RGBA()
+					r += basis * srgbToLinear(int(pr>>8))
+					g += basis * srgbToLinear(int(pg>>8))
+					b += basis * srgbToLinear(int(pb>>8))
+				}
+			}
+			scale := 1.0 / float64(width*height)
+			factors = append(factors, [3]float64{r * scale, g * scale, b * scale})
+		}
+	}
+
+	dc := factors[0]
+	ac := factors[1:]
+
+	var hash strings.Builder
+	hash.WriteString(encode83((xComponents-1)+(yComponents-1)*9, 1))
+
+	maximumValue := 1.0
+	if len(ac) > 0 {
+		var actualMax float64
+		for _, f := range ac {
+			actualMax = math.Max(actualMax, math.Abs(f[0]))
+			actualMax = math.Max(actualMax, math.Abs(f[1]))
+			actualMax = math.Max(actualMax, math.Abs(f[2]))
+		}
+		quantisedMax := int(math.Max(0, math.Min(82, math.Floor(actualMax*166-0.5))))
+		maximumValue = float64(quantisedMax+1) / 166.0
+		hash.WriteString(encode83(quantisedMax, 1))
+	} else {
+		hash.WriteString(encode83(0, 1))
+	}
+
+	hash.WriteString(encode83(encodeDC(dc), 4))
+	for _, f := range ac {
+		hash.WriteString(encode83(encodeAC(f, maximumValue), 2))
+	}
+
+	return hash.String()
+}
+
+func encodeDC(value [3]float64) int {
+	r := linearToSrgb(value[0])
+	g := linearToSrgb(value[1])
+	b := linearToSrgb(value[2])
+	return (r << 16) + (g << 8) + b
+}
+
+func encodeAC(value [3]float64, maximumValue float64) int {
+	quantR := quantizeAC(value[0], maximumValue)
+	quantG := quantizeAC(value[1], maximumValue)
+	quantB := quantizeAC(value[2], maximumValue)
+	return quantR*19*19 + quantG*19 + quantB
+}
+
+func quantizeAC(value, maximumValue float64) int {
+	quant := int(math.Floor(signPow(value/maximumValue, 0.5)*9 + 9.5))
+	return int(math.Max(0, math.Min(18, float64(quant))))
+}
+
+func signPow(value, exp float64) float64 {
+	sign := 1.0
+	if value < 0 {
+		sign = -1.0
+	}
+	return sign * math.Pow(math.Abs(value), exp)
+}
+
+func srgbToLinear(value int) float64 {
+	v := float64(value) / 255.0
+	if v <= 0.04045 {
+		return v / 12.92
+	}
+	return math.Pow((v+0.055)/1.055, 2.4)
+}
+
+func linearToSrgb(value float64) int {
+	v := math.Max(0, math.Min(1, value))
+	if v <= 0.0031308 {
+		return int(v*12.92*255 + 0.5)
+	}
+	return int((1.055*math.Pow(v, 1/2.4)-0.055)*255 + 0.5)
+}
+
+func encode83(value, length int) string {
+	result := make([]byte, length)
+	for i := 1; i <= length; i++ {
+		digit := (value / intPow(83, length-i)) % 83
+		result[i-1] = blurHashCharacters[digit]
+	}
+	return string(result)
+}
+
+func intPow(base, exp int) int {
+	result := 1
+	for i := 0; i < exp; i++ {
+		result *= base
+	}
+	return result
+}
@@ -0,0 +1,103 @@
+package chain
+
+import (
+	"image"
+	"image/color"
+	"strings"
+	"testing"
+)
+
+func solidImage(w, h int, c color.Color) image.Image {
+	img := image.NewRGBA(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			img.Set(x, y, c)
+		}
+	}
+	return img
+}
+
+func TestEncodeBlurHashLength(t *testing.T) {
+	tests := []struct {
+		name        string
+		xComponents int
+		yComponents int
+		wantLen     int
+	}{
+		{name: "4x3", xComponents: 4, yComponents: 3, wantLen: 1 + 1 + 4 + (4*3-1)*2},
+		{name: "1x1", xComponents: 1, yComponents: 1, wantLen: 1 + 1 + 4},
+		{name: "2x2", xComponents: 2, yComponents: 2, wantLen: 1 + 1 + 4 + (2*2-1)*2},
+	}
+	img := solidImage(16, 16, color.RGBA{R: 120, G: 80, B: 200, A: 255})
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := EncodeBlurHash(img, tt.xComponents, tt.yComponents)
+			if len(got) != tt.wantLen {
+				t.Errorf("EncodeBlurHash(%d, %d) length = %d, want %d", tt.xComponents, tt.yComponents, len(got), tt.wantLen)
+			}
+			for _, r := range got {
+				if !strings.ContainsRune(blurHashCharacters, r) {
+					t.Errorf("EncodeBlurHash(%d, %d) = %q contains character %q outside the base83 alphabet", tt.xComponents, tt.yComponents, got, r)
+				}
+			}
+		})
+	}
+}
+
+func TestEncodeBlurHashDeterministic(t *testing.T) {
+	img := solidImage(16, 16, color.RGBA{R: 10, G: 200, B: 50, A: 255})
+	first := EncodeBlurHash(img, 4, 3)
+	second := EncodeBlurHash(img, 4, 3)
+	if first != second {
+		t.Errorf("EncodeBlurHash is not deterministic: %q != %q", first, second)
+	}
+}
+
+func TestEncodeBlurHashDiffersByColor(t *testing.T) {
+	black := EncodeBlurHash(solidImage(16, 16, color.RGBA{A: 255}), 4, 3)
+	white := EncodeBlurHash(solidImage(16, 16, color.RGBA{R: 255, G: 255, B: 255, A: 255}), 4, 3)
+	if black == white {
+		t.Errorf("EncodeBlurHash produced the same hash for black and white images: %q", black)
+	}
+}
+
+func TestQuantizeACClampsToRange(t *testing.T) {
+	tests := []struct {
+		name        string
+		value       float64
+		maximumVal  float64
+		wantInRange bool
+	}{
+		{name: "far below max", value: -100, maximumVal: 1, wantInRange: true},
+		{name: "far above max", value: 100, maximumVal: 1, wantInRange: true},
+		{name: "zero", value: 0, maximumVal: 1, wantInRange: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := quantizeAC(tt.value, tt.maximumVal)
+			if got < 0 || got > 18 {
+				t.Errorf("quantizeAC(%v, %v) = %d, want in [0, 18]", tt.value, tt.maximumVal, got)
+			}
+		})
+	}
+}
+
+func TestSignPow(t *testing.T) {
+	tests := []struct {
+		name  string
+		value float64
+		exp   float64
+		want  float64
+	}{
+		{name: "positive", value: 4, exp: 0.5, want: 2},
+		{name: "negative", value: -4, exp: 0.5, want: -2},
+		{name: "zero", value: 0, exp: 0.5, want: 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := signPow(tt.value, tt.exp); got != tt.want {
+				t.Errorf("signPow(%v, %v) = %v, want %v", tt.value, tt.exp, got, tt.want)
+			}
+		})
+	}
+}
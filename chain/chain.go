@@ -0,0 +1,614 @@
+// Package chain holds the effect-chain core that used to live directly in
+// main's WASM entry point: the effect catalog, the chain of transformations
+// built from it, and the logic to render, reorder, serialize and apply that
+// chain to an image. None of it touches syscall/js, so it builds under any
+// GOOS and can be driven by the WASM UI and the batch CLI alike.
+package chain
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"image"
+	"image/color"
+	"image/draw"
+	"log"
+	"math"
+	"strconv"
+	"strings"
+
+	"github.com/anthonynsimon/bild/adjust"
+	"github.com/anthonynsimon/bild/blend"
+	"github.com/anthonynsimon/bild/blur"
+	"github.com/anthonynsimon/bild/effect"
+	"github.com/anthonynsimon/bild/noise"
+	"github.com/anthonynsimon/bild/segment"
+	"github.com/anthonynsimon/bild/transform"
+
+	"github.com/yml/wasmBild/pipeline"
+)
+
+const (
+	jpegPrefix = "data:image/jpeg;base64,"
+	pngPrefix  = "data:image/png;base64,"
+)
+
+type effectFn func(image.Image) image.Image
+
+// Param describes a single slider an Effect needs. Effects with several
+// independent knobs (e.g. noise's opacity and monochrome) list one Param
+// each, in the order GetEffectFn expects its values.
+type Param struct {
+	Name                    string
+	Min, Max, Step, Default float64
+}
+
+type Effect struct {
+	Name   string
+	Params []Param
+}
+
+func (eff *Effect) GetEffectFn(values ...float64) effectFn {
+	switch eff.Name {
+	case "brightness":
+		return func(img image.Image) image.Image { return adjust.Brightness(img, values[0]) }
+	case "contrast":
+		return func(img image.Image) image.Image { return adjust.Contrast(img, values[0]) }
+	case "edge-detection":
+		return func(img image.Image) image.Image { return effect.EdgeDetection(img, values[0]) }
+	case "blur-gaussian":
+		return func(img image.Image) image.Image { return blur.Gaussian(img, values[0]) }
+	case "blur-box":
+		return func(img image.Image) image.Image { return blur.Box(img, values[0]) }
+	case "noise":
+		return func(img image.Image) image.Image {
+			bounds := img.Bounds()
+			n := noise.Generate(bounds.Dx(), bounds.Dy(), &noise.Options{Monochrome: values[1] != 0})
+			return blend.Opacity(img, n, values[0])
+		}
+	case "segment-threshold":
+		return func(img image.Image) image.Image { return segment.Threshold(img, uint8(values[0])) }
+	case "sobel":
+		return func(img image.Image) image.Image { return effect.Sobel(img) }
+	case "emboss":
+		return func(img image.Image) image.Image { return effect.Emboss(img) }
+	case "sharpen":
+		return func(img image.Image) image.Image { return effect.Sharpen(img) }
+	case "median":
+		return func(img image.Image) image.Image { return effect.Median(img, values[0]) }
+	case "dilate":
+		return func(img image.Image) image.Image { return effect.Dilate(img, values[0]) }
+	case "erode":
+		return func(img image.Image) image.Image { return effect.Erode(img, values[0]) }
+	case "invert":
+		return func(img image.Image) image.Image { return effect.Invert(img) }
+	case "hue":
+		return func(img image.Image) image.Image { return adjust.Hue(img, int(values[0])) }
+	case "saturation":
+		return func(img image.Image) image.Image { return adjust.Saturation(img, values[0]) }
+	case "gamma":
+		return func(img image.Image) image.Image { return adjust.Gamma(img, values[0]) }
+
+	default:
+		log.Println("effect not found: ", eff.Name)
+		return nil
+	}
+}
+
+// paramView pairs a Param with the slider's current value and the DOM id it
+// is bound to, for use inside transformationTmpl.
+type paramView struct {
+	Id                    string
+	Name                  string
+	Min, Max, Step, Value float64
+}
+
+var transformationTmpl = `<div class="stage{{ if not .Enabled }} stage-disabled{{ end }}" id="{{ .Id }}__stage">
+<div class="stage-header">
+<span class="stage-name">{{ .Name }}</span>
+<input type="checkbox" id="{{ .Id }}__enabled" {{ if .Enabled }}checked{{ end }}>
+<button id="{{ .Id }}__up">up</button>
+<button id="{{ .Id }}__down">down</button>
+<button id="{{ .Id }}__remove">remove</button>
+</div>
+{{ range .Params }}<div><label for="{{ .Id }}">{{ .Name }}</label><input type="range" min="{{ .Min }}" max="{{ .Max }}" step="{{ .Step }}" value="{{ .Value }}" id="{{ .Id }}"></div>
+{{ end }}</div>`
+
+type transformFn func(values ...float64) effectFn
+
+type Transformation struct {
+	Effect
+	Id      string
+	Values  []float64
+	Enabled bool
+	Fn      transformFn
+}
+
+func (t *Transformation) Transform() effectFn {
+	return t.Fn(t.Values...)
+}
+
+func (t *Transformation) Render() string {
+	params := make([]paramView, len(t.Effect.Params))
+	for i, p := range t.Effect.Params {
+		params[i] = paramView{
+			Id:    t.Id + "__" + strconv.Itoa(i),
+			Name:  p.Name,
+			Min:   p.Min,
+			Max:   p.Max,
+			Step:  p.Step,
+			Value: t.Values[i],
+		}
+	}
+	data := struct {
+		Transformation
+		Params []paramView
+	}{Transformation: *t, Params: params}
+
+	var rendered strings.Builder
+	tmpl, err := template.New(t.Name).Parse(transformationTmpl)
+	if err != nil {
+		log.Println(err)
+	}
+	err = tmpl.Execute(&rendered, data)
+	if err != nil {
+		fmt.Println(err)
+	}
+	return rendered.String()
+}
+
+// App holds an effect catalog, the chain of Transformations built from it,
+// and the source/resized images that chain is applied to. It has no
+// knowledge of the DOM or of any particular frontend; JsApp (WASM) and the
+// batch CLI each drive it from the outside.
+type App struct {
+	cnt        int
+	dstWidth   int
+	sourceImg  image.Image
+	resizedImg image.Image
+
+	Effects []Effect
+
+	// Zebra, when true, tells callers displaying the target image to tint
+	// clipped pixels via ZebraOverlay before encoding it.
+	Zebra bool
+
+	transformations []Transformation
+}
+
+func NewApp() *App {
+	return &App{
+		transformations: make([]Transformation, 0),
+		Effects: []Effect{
+			{Name: "brightness", Params: []Param{
+				{Name: "amount", Min: -1, Max: 1, Step: 0.01, Default: 0},
+			}},
+			{Name: "contrast", Params: []Param{
+				{Name: "amount", Min: -1, Max: 1, Step: 0.01, Default: 0},
+			}},
+			{Name: "edge-detection", Params: []Param{
+				{Name: "radius", Min: 0, Max: 10, Step: 0.1, Default: 1},
+			}},
+			{Name: "blur-gaussian", Params: []Param{
+				{Name: "radius", Min: 0, Max: 50, Step: 0.5, Default: 2},
+			}},
+			{Name: "blur-box", Params: []Param{
+				{Name: "radius", Min: 0, Max: 50, Step: 0.5, Default: 2},
+			}},
+			{Name: "noise", Params: []Param{
+				{Name: "opacity", Min: 0, Max: 1, Step: 0.01, Default: 0.2},
+				{Name: "monochrome", Min: 0, Max: 1, Step: 1, Default: 1},
+			}},
+			{Name: "segment-threshold", Params: []Param{
+				{Name: "level", Min: 0, Max: 255, Step: 1, Default: 128},
+			}},
+			{Name: "sobel", Params: []Param{}},
+			{Name: "emboss", Params: []Param{}},
+			{Name: "sharpen", Params: []Param{}},
+			{Name: "median", Params: []Param{
+				{Name: "size", Min: 1, Max: 20, Step: 1, Default: 3},
+			}},
+			{Name: "dilate", Params: []Param{
+				{Name: "size", Min: 0, Max: 20, Step: 0.5, Default: 2},
+			}},
+			{Name: "erode", Params: []Param{
+				{Name: "size", Min: 0, Max: 20, Step: 0.5, Default: 2},
+			}},
+			{Name: "invert", Params: []Param{}},
+			{Name: "hue", Params: []Param{
+				{Name: "change", Min: -180, Max: 180, Step: 1, Default: 0},
+			}},
+			{Name: "saturation", Params: []Param{
+				{Name: "change", Min: -1, Max: 1, Step: 0.01, Default: 0},
+			}},
+			{Name: "gamma", Params: []Param{
+				{Name: "gamma", Min: 0.1, Max: 5, Step: 0.1, Default: 1},
+			}},
+		},
+		cnt:      0,
+		dstWidth: 200,
+	}
+}
+
+var appTmpl = `
+      <div id="uploader">
+        <input type="file" value="" name="uploader" id="uploader"/>
+      </div>
+      <div class="separator">preview:</div>
+        <div>
+                <div id="previewHash" class="blurhash"></div>
+                <image id="previewImg" class="image" />
+                <image id="targetImg" class="image" />
+        </div>
+      <label><input type="checkbox" id="zebraToggle"> zebra overlay</label>
+      <canvas id="histogram" width="256" height="100"></canvas>
+
+      <div class="separator">Select an effect:</div>
+      <select name="effect" id="effectSelector">
+	  {{ range .Effects }}<option name="{{ .Name }}" id="{{ .Name }}">{{ .Name }}</option>{{ end }}
+      </select>
+      <button id="addEffectBtn">Add</button>
+      <div id="effects">
+      </div>
+`
+
+func (app *App) Render() string {
+	var rendered strings.Builder
+	tmpl, err := template.New("app").Parse(appTmpl)
+	if err != nil {
+		fmt.Println(err)
+	}
+	err = tmpl.Execute(&rendered, app)
+	if err != nil {
+		fmt.Println(err)
+	}
+	return rendered.String()
+}
+
+// RenderEffects renders every stage currently in the chain, in order, for
+// insertion into the #effects div.
+func (app *App) RenderEffects() string {
+	var rendered strings.Builder
+	for i := range app.transformations {
+		rendered.WriteString(app.transformations[i].Render())
+	}
+	return rendered.String()
+}
+
+func (app *App) Append(t Transformation) {
+	app.transformations = append(app.transformations, t)
+	log.Println("lenght of app.transformations", len(app.transformations))
+}
+
+// NextTransformation builds a Transformation for the named effect with its
+// default parameter values, bumping the App's internal id counter so the
+// returned stage has a unique Id. It reports false if name isn't in
+// app.Effects.
+func (app *App) NextTransformation(name string) (Transformation, bool) {
+	var eff Effect
+	for _, e := range app.Effects {
+		if e.Name == name {
+			eff = e
+			break
+		}
+	}
+	if eff.Name == "" {
+		return Transformation{}, false
+	}
+
+	app.cnt++
+	values := make([]float64, len(eff.Params))
+	for i, p := range eff.Params {
+		values[i] = p.Default
+	}
+	return Transformation{
+		Effect:  eff,
+		Id:      name + strconv.Itoa(app.cnt),
+		Values:  values,
+		Enabled: true,
+		Fn:      eff.GetEffectFn,
+	}, true
+}
+
+// Remove drops the stage with the given Id from the chain, if present.
+func (app *App) Remove(Id string) {
+	for i, t := range app.transformations {
+		if t.Id == Id {
+			app.transformations = append(app.transformations[:i], app.transformations[i+1:]...)
+			return
+		}
+	}
+}
+
+// Reorder moves the stage with the given Id to newIndex, shifting the
+// remaining stages to make room. Out-of-range newIndex values are clamped.
+func (app *App) Reorder(Id string, newIndex int) {
+	idx := app.IndexOf(Id)
+	if idx == -1 {
+		return
+	}
+	if newIndex < 0 {
+		newIndex = 0
+	}
+	if newIndex > len(app.transformations)-1 {
+		newIndex = len(app.transformations) - 1
+	}
+	if newIndex == idx {
+		return
+	}
+	t := app.transformations[idx]
+	app.transformations = append(app.transformations[:idx], app.transformations[idx+1:]...)
+	app.transformations = append(app.transformations[:newIndex], append([]Transformation{t}, app.transformations[newIndex:]...)...)
+}
+
+// SetEnabled toggles whether the stage with the given Id participates in
+// PreviewImg.
+func (app *App) SetEnabled(Id string, enabled bool) {
+	for i, t := range app.transformations {
+		if t.Id == Id {
+			t.Enabled = enabled
+			app.transformations[i] = t
+			break
+		}
+	}
+}
+
+func (app *App) Update(Id string, values ...float64) {
+	for i, t := range app.transformations {
+		if t.Id == Id {
+			t.Values = values
+			app.transformations[i] = t
+			break
+		}
+	}
+}
+
+// UpdateParam sets a single slider value on the stage with the given Id,
+// leaving the rest of its Values untouched.
+func (app *App) UpdateParam(Id string, paramIndex int, value float64) {
+	for i, t := range app.transformations {
+		if t.Id == Id {
+			if paramIndex < 0 || paramIndex >= len(t.Values) {
+				return
+			}
+			t.Values[paramIndex] = value
+			app.transformations[i] = t
+			break
+		}
+	}
+}
+
+// IndexOf returns the position of the stage with the given Id, or -1 if no
+// such stage exists.
+func (app *App) IndexOf(Id string) int {
+	for i, t := range app.transformations {
+		if t.Id == Id {
+			return i
+		}
+	}
+	return -1
+}
+
+// SetDstWidth sets the width images are resized to before the chain is
+// applied; height follows to preserve the source aspect ratio.
+func (app *App) SetDstWidth(w int) {
+	app.dstWidth = w
+}
+
+// ResizedImg returns the most recently loaded source image, resized to
+// dstWidth.
+func (app *App) ResizedImg() image.Image {
+	return app.resizedImg
+}
+
+// LoadImage adopts img as the current source image and resizes it to
+// dstWidth, ready for PreviewImg.
+func (app *App) LoadImage(img image.Image) {
+	app.sourceImg = img
+	app.resize()
+}
+
+func (app *App) resize() {
+	srcWidth, srcHeight := app.sourceImg.Bounds().Dx(), app.sourceImg.Bounds().Dy()
+	dstWidth := app.dstWidth
+	ratio := float64(srcHeight) / float64(srcWidth)
+	dstHeight := int(math.Ceil(ratio * float64(dstWidth)))
+	app.resizedImg = transform.Resize(app.sourceImg, dstWidth, dstHeight, transform.Linear)
+}
+
+func (app *App) NewSourceImgFromString(simg string) {
+	switch {
+	case strings.HasPrefix(simg, jpegPrefix):
+		simg = strings.TrimPrefix(simg, jpegPrefix)
+	case strings.HasPrefix(simg, pngPrefix):
+		simg = strings.TrimPrefix(simg, pngPrefix)
+	default:
+		log.Println("unrecognized image format")
+		return
+	}
+
+	reader := base64.NewDecoder(base64.StdEncoding, strings.NewReader(simg))
+	img, _, err := image.Decode(reader)
+	if err != nil {
+		log.Println(err.Error())
+		return
+	}
+	app.LoadImage(img)
+}
+
+// BlurHash encodes the current resizedImg as a BlurHash string using the
+// standard 4x3 component grid, for an instant low-res placeholder while the
+// full JPEG preview is still rendering.
+func (app *App) BlurHash() string {
+	if app.resizedImg == nil {
+		return ""
+	}
+	return EncodeBlurHash(app.resizedImg, 4, 3)
+}
+
+func (app *App) PreviewImg() image.Image {
+	img := app.resizedImg
+	for _, t := range app.transformations {
+		if !t.Enabled {
+			continue
+		}
+		log.Println(t.Id)
+		img = t.Transform()(img)
+	}
+	return img
+}
+
+// stateEntry is the on-the-wire representation of a single chain stage,
+// used by MarshalState/LoadState.
+type stateEntry struct {
+	Name    string    `json:"name"`
+	Values  []float64 `json:"values"`
+	Enabled bool      `json:"enabled"`
+}
+
+// MarshalState encodes the current transformation chain as a compact,
+// base64-encoded JSON blob suitable for a URL hash, a localStorage entry, or
+// the batch CLI's -state flag.
+func (app *App) MarshalState() string {
+	entries := make([]stateEntry, len(app.transformations))
+	for i, t := range app.transformations {
+		entries[i] = stateEntry{Name: t.Name, Values: t.Values, Enabled: t.Enabled}
+	}
+	data, err := json.Marshal(entries)
+	if err != nil {
+		log.Println(err.Error())
+		return ""
+	}
+	return base64.StdEncoding.EncodeToString(data)
+}
+
+// LoadState rebuilds the transformation chain from a blob produced by
+// MarshalState, matching each entry back to its Effect by name. Entries
+// whose effect no longer exists, or whose value count no longer matches the
+// effect's Params, are skipped rather than crashing the chain.
+func (app *App) LoadState(s string) {
+	data, err := base64.StdEncoding.DecodeString(s)
+	if err != nil {
+		log.Println(err.Error())
+		return
+	}
+	var entries []stateEntry
+	if err := json.Unmarshal(data, &entries); err != nil {
+		log.Println(err.Error())
+		return
+	}
+
+	transformations := make([]Transformation, 0, len(entries))
+	for _, e := range entries {
+		var eff Effect
+		for _, candidate := range app.Effects {
+			if candidate.Name == e.Name {
+				eff = candidate
+				break
+			}
+		}
+		if eff.Name == "" || len(e.Values) != len(eff.Params) {
+			continue
+		}
+		app.cnt++
+		transformations = append(transformations, Transformation{
+			Effect:  eff,
+			Id:      eff.Name + strconv.Itoa(app.cnt),
+			Values:  e.Values,
+			Enabled: e.Enabled,
+			Fn:      eff.GetEffectFn,
+		})
+	}
+	app.transformations = transformations
+}
+
+// Stages snapshots the current transformation chain as pipeline.Stages, so a
+// job can run against the chain as it was at submission time even if the
+// user keeps editing it while the job is in flight.
+func (app *App) Stages() []pipeline.Stage {
+	stages := make([]pipeline.Stage, len(app.transformations))
+	for i, t := range app.transformations {
+		stages[i] = pipeline.Stage{Name: t.Id, Enabled: t.Enabled, Apply: t.Transform()}
+	}
+	return stages
+}
+
+// StageSpecs snapshots the current chain as pipeline.StageSpecs: unlike
+// Stages, these carry the effect name and raw parameter values instead of a
+// closure, so they can cross a postMessage boundary to a companion Worker
+// and be rebuilt there by BuildStage.
+func (app *App) StageSpecs() []pipeline.StageSpec {
+	specs := make([]pipeline.StageSpec, len(app.transformations))
+	for i, t := range app.transformations {
+		specs[i] = pipeline.StageSpec{EffectName: t.Effect.Name, Values: t.Values, Enabled: t.Enabled}
+	}
+	return specs
+}
+
+// BuildStage resolves a StageSpec back into a Stage by matching EffectName
+// against app.Effects, the same catalog NextTransformation and LoadState
+// match against. It reports false if EffectName isn't recognized.
+func (app *App) BuildStage(spec pipeline.StageSpec) (pipeline.Stage, bool) {
+	for _, eff := range app.Effects {
+		if eff.Name == spec.EffectName {
+			return pipeline.Stage{Name: spec.EffectName, Enabled: spec.Enabled, Apply: eff.GetEffectFn(spec.Values...)}, true
+		}
+	}
+	return pipeline.Stage{}, false
+}
+
+// Histogram is a per-channel 256-bin count of an image's pixel values, plus
+// how many pixels are fully clipped (at 0 or 255 in at least one channel).
+type Histogram struct {
+	R, G, B, L              [256]uint32
+	ClippedLow, ClippedHigh int
+}
+
+// Histogram computes per-channel histograms and clipping counts for img.
+// It takes no App state and touches no DOM, so it's directly testable
+// without a browser.
+func (app *App) Histogram(img image.Image) Histogram {
+	var h Histogram
+	bounds := img.Bounds()
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			r, g, b, _ := img.At(x, y).RGBA()
+			r8, g8, b8 := uint8(r>>8), uint8(g>>8), uint8(b>>8)
+			h.R[r8]++
+			h.G[g8]++
+			h.B[b8]++
+			h.L[uint8(0.2126*float64(r8)+0.7152*float64(g8)+0.0722*float64(b8))]++
+
+			if r8 == 0 || g8 == 0 || b8 == 0 {
+				h.ClippedLow++
+			}
+			if r8 == 255 || g8 == 255 || b8 == 255 {
+				h.ClippedHigh++
+			}
+		}
+	}
+	return h
+}
+
+var zebraTint = color.RGBA{R: 255, G: 0, B: 255, A: 255}
+
+// ZebraOverlay returns a copy of img with every pixel clipped at 0 or 255 in
+// any channel tinted magenta, so a user pulling brightness/contrast can see
+// exactly what they're blowing out before it's baked into the JPEG.
+func ZebraOverlay(img image.Image) image.Image {
+	bounds := img.Bounds()
+	out := image.NewRGBA(bounds)
+	draw.Draw(out, bounds, img, bounds.Min, draw.Src)
+
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			r, g, b, _ := img.At(x, y).RGBA()
+			r8, g8, b8 := uint8(r>>8), uint8(g>>8), uint8(b>>8)
+			if r8 == 0 || g8 == 0 || b8 == 0 || r8 == 255 || g8 == 255 || b8 == 255 {
+				out.SetRGBA(x, y, zebraTint)
+			}
+		}
+	}
+	return out
+}
@@ -0,0 +1,79 @@
+package chain
+
+import (
+	"image"
+	"image/color"
+	"testing"
+)
+
+func TestAppHistogram(t *testing.T) {
+	tests := []struct {
+		name           string
+		img            image.Image
+		wantClippedLow int
+		wantClippedHi  int
+		checkBin       func(h Histogram) uint32
+		wantBinCount   uint32
+	}{
+		{
+			name:           "solid mid-gray has no clipping",
+			img:            solidImage(4, 4, color.RGBA{R: 128, G: 128, B: 128, A: 255}),
+			wantClippedLow: 0,
+			wantClippedHi:  0,
+			checkBin:       func(h Histogram) uint32 { return h.R[128] },
+			wantBinCount:   16,
+		},
+		{
+			name:           "solid black clips low in every channel",
+			img:            solidImage(3, 3, color.RGBA{A: 255}),
+			wantClippedLow: 9,
+			wantClippedHi:  0,
+			checkBin:       func(h Histogram) uint32 { return h.R[0] },
+			wantBinCount:   9,
+		},
+		{
+			name:           "solid white clips high in every channel",
+			img:            solidImage(2, 5, color.RGBA{R: 255, G: 255, B: 255, A: 255}),
+			wantClippedLow: 0,
+			wantClippedHi:  10,
+			checkBin:       func(h Histogram) uint32 { return h.B[255] },
+			wantBinCount:   10,
+		},
+	}
+
+	app := NewApp()
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := app.Histogram(tt.img)
+			if h.ClippedLow != tt.wantClippedLow {
+				t.Errorf("ClippedLow = %d, want %d", h.ClippedLow, tt.wantClippedLow)
+			}
+			if h.ClippedHigh != tt.wantClippedHi {
+				t.Errorf("ClippedHigh = %d, want %d", h.ClippedHigh, tt.wantClippedHi)
+			}
+			if got := tt.checkBin(h); got != tt.wantBinCount {
+				t.Errorf("checked bin = %d, want %d", got, tt.wantBinCount)
+			}
+		})
+	}
+}
+
+func TestZebraOverlay(t *testing.T) {
+	img := image.NewRGBA(image.Rect(0, 0, 2, 1))
+	img.SetRGBA(0, 0, color.RGBA{R: 128, G: 128, B: 128, A: 255})
+	img.SetRGBA(1, 0, color.RGBA{R: 255, G: 10, B: 10, A: 255})
+
+	out := ZebraOverlay(img)
+
+	if got := colorAt(out, 0, 0); got != (color.RGBA{R: 128, G: 128, B: 128, A: 255}) {
+		t.Errorf("unclipped pixel (0,0) = %v, want untouched gray", got)
+	}
+	if got := colorAt(out, 1, 0); got != zebraTint {
+		t.Errorf("clipped pixel (1,0) = %v, want zebraTint %v", got, zebraTint)
+	}
+}
+
+func colorAt(img image.Image, x, y int) color.RGBA {
+	r, g, b, a := img.At(x, y).RGBA()
+	return color.RGBA{R: uint8(r >> 8), G: uint8(g >> 8), B: uint8(b >> 8), A: uint8(a >> 8)}
+}
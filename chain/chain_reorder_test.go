@@ -0,0 +1,87 @@
+package chain
+
+import (
+	"reflect"
+	"testing"
+)
+
+func idsOf(app *App) []string {
+	ids := make([]string, len(app.transformations))
+	for i, t := range app.transformations {
+		ids[i] = t.Id
+	}
+	return ids
+}
+
+func appWithStages(t *testing.T, names ...string) *App {
+	t.Helper()
+	app := NewApp()
+	for _, name := range names {
+		tr, ok := app.NextTransformation(name)
+		if !ok {
+			t.Fatalf("NextTransformation(%q) failed", name)
+		}
+		app.Append(tr)
+	}
+	return app
+}
+
+func TestAppReorder(t *testing.T) {
+	tests := []struct {
+		name     string
+		moveId   func(ids []string) string
+		newIndex int
+		want     []string
+	}{
+		{
+			name:     "move first to last",
+			moveId:   func(ids []string) string { return ids[0] },
+			newIndex: 2,
+			want:     []string{"contrast2", "sharpen3", "brightness1"},
+		},
+		{
+			name:     "move last to first",
+			moveId:   func(ids []string) string { return ids[2] },
+			newIndex: 0,
+			want:     []string{"sharpen3", "brightness1", "contrast2"},
+		},
+		{
+			name:     "negative index clamps to 0",
+			moveId:   func(ids []string) string { return ids[2] },
+			newIndex: -5,
+			want:     []string{"sharpen3", "brightness1", "contrast2"},
+		},
+		{
+			name:     "out-of-range index clamps to the end",
+			moveId:   func(ids []string) string { return ids[0] },
+			newIndex: 99,
+			want:     []string{"contrast2", "sharpen3", "brightness1"},
+		},
+		{
+			name:     "same index is a no-op",
+			moveId:   func(ids []string) string { return ids[1] },
+			newIndex: 1,
+			want:     []string{"brightness1", "contrast2", "sharpen3"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app := appWithStages(t, "brightness", "contrast", "sharpen")
+			id := tt.moveId(idsOf(app))
+			app.Reorder(id, tt.newIndex)
+			if got := idsOf(app); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Reorder(%q, %d) order = %v, want %v", id, tt.newIndex, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestAppReorderUnknownIdIsNoop(t *testing.T) {
+	app := appWithStages(t, "brightness", "contrast")
+	before := idsOf(app)
+	app.Reorder("does-not-exist", 0)
+	if got := idsOf(app); !reflect.DeepEqual(got, before) {
+		t.Errorf("Reorder with unknown Id changed order: %v -> %v", before, got)
+	}
+}
@@ -0,0 +1,79 @@
+package chain
+
+import (
+	"encoding/base64"
+	"reflect"
+	"testing"
+)
+
+func TestMarshalStateLoadStateRoundTrip(t *testing.T) {
+	app := appWithStages(t, "brightness", "contrast")
+	app.UpdateParam(idsOf(app)[0], 0, 0.5)
+	app.SetEnabled(idsOf(app)[1], false)
+
+	blob := app.MarshalState()
+
+	loaded := NewApp()
+	loaded.LoadState(blob)
+
+	if len(loaded.transformations) != len(app.transformations) {
+		t.Fatalf("LoadState produced %d stages, want %d", len(loaded.transformations), len(app.transformations))
+	}
+	for i, want := range app.transformations {
+		got := loaded.transformations[i]
+		if got.Name != want.Name {
+			t.Errorf("stage %d Name = %q, want %q", i, got.Name, want.Name)
+		}
+		if !reflect.DeepEqual(got.Values, want.Values) {
+			t.Errorf("stage %d Values = %v, want %v", i, got.Values, want.Values)
+		}
+		if got.Enabled != want.Enabled {
+			t.Errorf("stage %d Enabled = %v, want %v", i, got.Enabled, want.Enabled)
+		}
+	}
+}
+
+func TestLoadStateSkipsStaleEffectName(t *testing.T) {
+	app := appWithStages(t, "brightness")
+	blob := `[{"name":"brightness","values":[0.5],"enabled":true},{"name":"no-longer-exists","values":[1],"enabled":true}]`
+	app.LoadState(encodeState(blob))
+
+	if len(app.transformations) != 1 {
+		t.Fatalf("LoadState kept %d stages, want 1 (the stale effect should be skipped)", len(app.transformations))
+	}
+	if app.transformations[0].Name != "brightness" {
+		t.Errorf("surviving stage Name = %q, want %q", app.transformations[0].Name, "brightness")
+	}
+}
+
+func TestLoadStateSkipsValueCountMismatch(t *testing.T) {
+	blob := `[{"name":"brightness","values":[0.1,0.2],"enabled":true}]`
+	app := NewApp()
+	app.LoadState(encodeState(blob))
+
+	if len(app.transformations) != 0 {
+		t.Fatalf("LoadState kept %d stages, want 0 (value count mismatch should be skipped)", len(app.transformations))
+	}
+}
+
+func TestLoadStateCorruptedBlobLeavesChainUntouched(t *testing.T) {
+	app := appWithStages(t, "brightness")
+	before := idsOf(app)
+
+	app.LoadState("not valid base64!!")
+	if got := idsOf(app); !reflect.DeepEqual(got, before) {
+		t.Errorf("LoadState with invalid base64 changed the chain: %v -> %v", before, got)
+	}
+
+	app.LoadState(encodeState(`not valid json`))
+	if got := idsOf(app); !reflect.DeepEqual(got, before) {
+		t.Errorf("LoadState with invalid JSON changed the chain: %v -> %v", before, got)
+	}
+}
+
+// encodeState base64-encodes a raw JSON state blob the same way
+// MarshalState would, so tests can exercise LoadState against
+// hand-written entries instead of only round-tripping MarshalState.
+func encodeState(json string) string {
+	return base64.StdEncoding.EncodeToString([]byte(json))
+}
@@ -0,0 +1,83 @@
+//go:build !js
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/anthonynsimon/bild/imgio"
+
+	"github.com/yml/wasmBild/chain"
+)
+
+// main is the batch-rendering counterpart to the WASM UI: given a state
+// blob produced by App.MarshalState (e.g. copied from a shared preview URL),
+// it applies the same effect chain to every image in a directory and writes
+// the results to an output directory, each resized to -width first.
+func main() {
+	var stateBlob, inDir, outDir string
+	var width int
+	flag.StringVar(&stateBlob, "state", "", "base64 filter-chain state, as produced by the browser UI's shareable URL")
+	flag.StringVar(&inDir, "in", "", "directory of input images to process")
+	flag.StringVar(&outDir, "out", "", "directory to write processed images to")
+	flag.IntVar(&width, "width", 200, "target width to resize images to before applying the chain")
+	flag.Parse()
+
+	if stateBlob == "" || inDir == "" || outDir == "" {
+		fmt.Fprintln(os.Stderr, "usage: wasmbild -state <blob> -in <dir> -out <dir> [-width 200]")
+		os.Exit(1)
+	}
+
+	app := chain.NewApp()
+	app.SetDstWidth(width)
+	app.LoadState(stateBlob)
+
+	if err := os.MkdirAll(outDir, 0o755); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	entries, err := os.ReadDir(inDir)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	for _, entry := range entries {
+		if entry.IsDir() {
+			continue
+		}
+		src := filepath.Join(inDir, entry.Name())
+		img, err := imgio.Open(src)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "skipping", src, err)
+			continue
+		}
+
+		app.LoadImage(img)
+		dst := filepath.Join(outDir, outputName(entry.Name()))
+		if err := imgio.Save(dst, app.PreviewImg(), encoderFor(dst)); err != nil {
+			fmt.Fprintln(os.Stderr, "failed to write", dst, err)
+			continue
+		}
+		fmt.Println(dst)
+	}
+}
+
+func outputName(name string) string {
+	if strings.ToLower(filepath.Ext(name)) == ".png" {
+		return name
+	}
+	return strings.TrimSuffix(name, filepath.Ext(name)) + ".jpg"
+}
+
+func encoderFor(path string) imgio.Encoder {
+	if strings.ToLower(filepath.Ext(path)) == ".png" {
+		return imgio.PNGEncoder()
+	}
+	return imgio.JPEGEncoder(90)
+}
@@ -1,20 +1,21 @@
+//go:build js
+
 package main
 
 import (
 	"bytes"
 	"encoding/base64"
-	"fmt"
-	"html/template"
 	"image"
-	"math"
+	"image/draw"
 	"strconv"
 	"strings"
+	"sync/atomic"
 	"syscall/js"
 
-	"github.com/anthonynsimon/bild/adjust"
-	"github.com/anthonynsimon/bild/effect"
 	"github.com/anthonynsimon/bild/imgio"
-	"github.com/anthonynsimon/bild/transform"
+
+	"github.com/yml/wasmBild/chain"
+	"github.com/yml/wasmBild/pipeline"
 )
 
 const (
@@ -25,7 +26,11 @@ const (
 
 func main() {
 	println("starting go wasm")
-	app := NewApp()
+	if isWorkerContext() {
+		runWorkerMode()
+		select {} // keep the wasm instance alive to keep handling postMessage jobs
+	}
+	app := chain.NewApp()
 	jsa := NewJsApp(*app)
 	select {
 	case <-jsa.done:
@@ -34,257 +39,346 @@ func main() {
 	println("ending go wasm")
 }
 
-type effectFn func(image.Image) image.Image
-
-type Effect struct {
-	Name     string
-	Min, Max int
-}
+const workerPoolSize = 4
+const tilePreviewHeight = 16
 
-func (eff *Effect) GetEffectFn(values ...float64) effectFn {
-	switch eff.Name {
-	case "brightness":
-		return func(img image.Image) image.Image { return adjust.Brightness(img, values[0]) }
-	case "contrast":
-		return func(img image.Image) image.Image { return adjust.Contrast(img, values[0]) }
-	case "edge-detection":
-		return func(img image.Image) image.Image { return effect.EdgeDetection(img, values[0]) }
-
-	default:
-		log("effect not found: ", eff.Name)
-		return nil
-	}
-}
-
-var transformationTmpl = `<div><label for="{{ .Name }}">{{ .Name }}</label><input type="range" min="{{ .Min }}" max="{{ .Max}}" value="0" step="0.1" id="{{ .Id }}"></div>`
-
-type transformFn func(values ...float64) effectFn
-
-type Transformation struct {
-	Effect
-	Id     string
-	Values []float64
-	Fn     transformFn
-}
-
-func (t *Transformation) Transform() effectFn {
-
-	return t.Fn(t.Values...)
-}
+type JsApp struct {
+	chain.App
+	done chan struct{}
 
-func (t *Transformation) Render() string {
-	var rendered strings.Builder
-	tmpl, err := template.New(t.Name).Parse(transformationTmpl)
-	if err != nil {
-		log(err)
-	}
-	err = tmpl.Execute(&rendered, t)
-	if err != nil {
-		fmt.Println(err)
-	}
-	return rendered.String()
-}
+	ShutdownCallback      js.Func
+	UploadCallback        js.Func
+	AddEffectCallback     js.Func
+	ChangeEffectsCallback js.Func
+	EffectsInputCallback  js.Func
+	EffectsClickCallback  js.Func
+	ZebraCallback         js.Func
 
-type App struct {
-	buf        bytes.Buffer
-	cnt        int
-	dstWidth   int
-	sourceImg  image.Image
-	resizedImg image.Image
+	pipe      pipeline.Runner
+	nextJobID int64
 
-	Effects []Effect
+	lastTarget image.Image
 
-	transformations []Transformation
-}
+	// tileJobID and tileCanvas accumulate SubmitTiled strips into a single
+	// image so handleTileResult can push a partial preview to targetImg as
+	// soon as each strip completes, instead of waiting for the whole job.
+	tileJobID  int
+	tileCanvas *image.RGBA
 
-func NewApp() *App {
-	return &App{
-		transformations: make([]Transformation, 0),
-		Effects: []Effect{
-			Effect{
-				Name: "contrast",
-				Min:  -2,
-				Max:  2,
-			},
-			Effect{
-				Name: "brightness",
-				Min:  -2,
-				Max:  2,
-			},
-			Effect{
-				Name: "edge-detection",
-				Min:  -2,
-				Max:  2,
-			},
-		},
-		cnt:      0,
-		dstWidth: 200,
-	}
+	buf bytes.Buffer
 }
 
-var appTmpl = `
-      <div id="uploader">
-        <input type="file" value="" name="uploader" id="uploader"/>
-      </div>
-      <div class="separator">preview:</div>
-        <div>
-                <image id="previewImg" class="image" />
-                <image id="targetImg" class="image" />
-        </div>
-
-      <div class="separator">Select an effect:</div>
-      <select name="effect" id="effectSelector">
-	  {{ range .Effects }}<option name="{{ .Name }}" id="{{ .Name }}">{{ .Name }}</option>{{ end }}
-      </select>
-      <button id="addEffectBtn">Add</button>
-      <div id="effects">
-      </div>
-`
-
-func (app *App) Render() string {
-	var rendered strings.Builder
-	tmpl, err := template.New("app").Parse(appTmpl)
+func NewJsApp(app chain.App) *JsApp {
+	var pipe pipeline.Runner
+	wp, err := pipeline.NewWorkerPool(workerPoolSize, "worker.js")
 	if err != nil {
-		// log(err)
-		fmt.Println(err)
+		log("falling back to the in-process pipeline:", err.Error())
+		pipe = pipeline.New(workerPoolSize)
+	} else {
+		pipe = wp
 	}
-	err = tmpl.Execute(&rendered, app)
-	if err != nil {
-		fmt.Println(err)
+	jsa := &JsApp{
+		App:  app,
+		pipe: pipe,
+		done: make(chan struct{}),
 	}
-	return rendered.String()
-}
 
-func (app *App) Append(t Transformation) {
-	app.transformations = append(app.transformations, t)
-	log("lenght of app.transformations", len(app.transformations))
-}
-
-func (app *App) Update(Id string, values ...float64) {
-	for i, t := range app.transformations {
-		if t.Id == Id {
-			t.Values = values
-			app.transformations[i] = t
-			break
+	go func() {
+		for res := range jsa.pipe.Results() {
+			jsa.displayTarget(res.Img)
 		}
-	}
-}
-
-func (app *App) NewSourceImgFromString(simg string) {
-	switch {
-	case strings.HasPrefix(simg, jpegPrefix):
-		simg = strings.TrimPrefix(simg, jpegPrefix)
-	case strings.HasPrefix(simg, pngPrefix):
-		simg = strings.TrimPrefix(simg, pngPrefix)
-	default:
-		log("unrecognized image format")
-		return
-	}
-
-	reader := base64.NewDecoder(base64.StdEncoding, strings.NewReader(simg))
-	var err error
-	app.sourceImg, _, err = image.Decode(reader)
-	if err != nil {
-		log(err.Error())
-		return
-	}
-	srcWidth, srcHeight := app.sourceImg.Bounds().Dx(), app.sourceImg.Bounds().Dy()
-	dstWidth := app.dstWidth
-	ratio := float64(srcHeight) / float64(srcWidth)
-	dstHeight := int(math.Ceil(ratio * float64(dstWidth)))
-	app.resizedImg = transform.Resize(app.sourceImg, dstWidth, dstHeight, transform.Linear)
-
-}
-
-func (app *App) PreviewImg() image.Image {
-	img := app.resizedImg
-	for _, t := range app.transformations {
-		log(t.Id)
-		img = t.Transform()(img)
-	}
-	return img
-}
-
-type JsApp struct {
-	App
-	done chan struct{}
+	}()
 
-	ShutdownCallback      js.Callback
-	UploadCallback        js.Callback
-	AddEffectCallback     js.Callback
-	ChangeEffectsCallback js.Callback
+	go func() {
+		for tr := range jsa.pipe.TileResults() {
+			jsa.handleTileResult(tr)
+		}
+	}()
 
-	buf bytes.Buffer
-}
+	getElementById("app").Call("insertAdjacentHTML", "beforeend", jsa.App.Render())
 
-func NewJsApp(app App) *JsApp {
-	jsa := &JsApp{
-		App:  app,
-		done: make(chan struct{}),
+	if state := readStoredState(); state != "" {
+		jsa.LoadState(state)
+		getElementById("effects").Set("innerHTML", jsa.RenderEffects())
 	}
 
-	getElementById("app").Call("insertAdjacentHTML", "beforeend", jsa.App.Render())
-
-	jsa.ShutdownCallback = js.NewEventCallback(js.StopPropagation, func(ev js.Value) {
+	jsa.ShutdownCallback = js.FuncOf(func(this js.Value, args []js.Value) interface{} {
+		ev := args[0]
+		ev.Call("stopPropagation")
 		log("event", ev)
 		ev.Get("target").Set("disabled", true)
 		getElementById("status").Set("innerText", "go wasm app is closed")
 		getElementById("app").Set("innerHTML", "")
 		jsa.done <- struct{}{}
+		return nil
 	})
 	getElementById("shutdownBtn").Call("addEventListener", "click", jsa.ShutdownCallback)
 
-	jsa.UploadCallback = js.NewEventCallback(js.PreventDefault, func(ev js.Value) {
+	jsa.UploadCallback = js.FuncOf(func(this js.Value, args []js.Value) interface{} {
+		ev := args[0]
+		ev.Call("preventDefault")
 		log("event", ev)
 		file := ev.Get("target").Get("files").Get("0")
 		freader := js.Global().Get("FileReader").New()
-		freader.Set("onload", js.NewEventCallback(js.PreventDefault, func(ev js.Value) {
+		var onload js.Func
+		onload = js.FuncOf(func(this js.Value, args []js.Value) interface{} {
+			ev := args[0]
+			ev.Call("preventDefault")
 			jsa.NewSourceImgFromString(ev.Get("target").Get("result").String())
-			jsa.UpdateImgSrcById("previewImg", jsa.resizedImg)
-			jsa.UpdateImgSrcById("targetImg", jsa.PreviewImg())
-		}))
+			jsa.UpdateBlurHash("previewHash", jsa.BlurHash())
+			jsa.UpdateImgSrcById("previewImg", jsa.ResizedImg())
+			jsa.displayTarget(jsa.PreviewImg())
+			onload.Release()
+			return nil
+		})
+		freader.Set("onload", onload)
 		freader.Call("readAsDataURL", file)
+		return nil
 	})
 	getElementById("uploader").Call("addEventListener", "change", jsa.UploadCallback)
 
-	jsa.AddEffectCallback = js.NewEventCallback(js.StopPropagation, func(ev js.Value) {
+	jsa.AddEffectCallback = js.FuncOf(func(this js.Value, args []js.Value) interface{} {
+		ev := args[0]
+		ev.Call("stopPropagation")
 		log("event", ev)
-		jsa.cnt++
 		effectSelector := getElementById("effectSelector")
 		effectSelected := effectSelector.Get("options").Call("item", effectSelector.Get("selectedIndex"))
 		log(effectSelected)
-		eff := Effect{
-			Name: effectSelected.Get("id").String(),
-			Min:  -2,
-			Max:  2,
-		}
-		t := Transformation{
-			Effect: eff,
-			Id:     effectSelected.Get("id").String() + strconv.Itoa(jsa.cnt),
-			Values: []float64{0}, // default value
-			Fn:     eff.GetEffectFn,
+		t, ok := jsa.NextTransformation(effectSelected.Get("id").String())
+		if !ok {
+			return nil
 		}
 		jsa.Append(t)
-		getElementById("effects").Call("insertAdjacentHTML", "beforeend", t.Render())
+		getElementById("effects").Set("innerHTML", jsa.RenderEffects())
+		jsa.submitPreviewJob()
+		jsa.persistState()
+		return nil
 	})
 	getElementById("addEffectBtn").Call("addEventListener", "click", jsa.AddEffectCallback)
 
-	jsa.ChangeEffectsCallback = js.NewEventCallback(js.PreventDefault, func(ev js.Value) {
+	jsa.ChangeEffectsCallback = js.FuncOf(func(this js.Value, args []js.Value) interface{} {
+		ev := args[0]
+		ev.Call("preventDefault")
 		log("event", ev)
-		jsa.Update(ev.Get("target").Get("id").String(), ev.Get("target").Get("valueAsNumber").Float())
-		jsa.UpdateImgSrcById("targetImg", jsa.PreviewImg())
+		target := ev.Get("target")
+		id := target.Get("id").String()
+
+		if strings.HasSuffix(id, "__enabled") {
+			jsa.SetEnabled(strings.TrimSuffix(id, "__enabled"), target.Get("checked").Bool())
+			jsa.submitPreviewJob()
+			jsa.persistState()
+			return nil
+		}
+
+		stageId, paramIndex, ok := splitParamId(id)
+		if !ok {
+			return nil
+		}
+		jsa.UpdateParam(stageId, paramIndex, target.Get("valueAsNumber").Float())
+		jsa.submitPreviewJob()
+		jsa.persistState()
+		return nil
 	})
 	getElementById("effects").Call("addEventListener", "change", jsa.ChangeEffectsCallback)
 
+	// input fires continuously while a range slider is being dragged, unlike
+	// change which only fires on release; route it to the tiled pipeline so
+	// the preview stays responsive mid-drag instead of sitting stale until
+	// the user lets go.
+	jsa.EffectsInputCallback = js.FuncOf(func(this js.Value, args []js.Value) interface{} {
+		ev := args[0]
+		ev.Call("preventDefault")
+		target := ev.Get("target")
+		stageId, paramIndex, ok := splitParamId(target.Get("id").String())
+		if !ok {
+			return nil
+		}
+		jsa.UpdateParam(stageId, paramIndex, target.Get("valueAsNumber").Float())
+		jsa.submitTiledPreviewJob()
+		return nil
+	})
+	getElementById("effects").Call("addEventListener", "input", jsa.EffectsInputCallback)
+
+	jsa.EffectsClickCallback = js.FuncOf(func(this js.Value, args []js.Value) interface{} {
+		ev := args[0]
+		ev.Call("stopPropagation")
+		id := ev.Get("target").Get("id").String()
+		switch {
+		case strings.HasSuffix(id, "__remove"):
+			jsa.Remove(strings.TrimSuffix(id, "__remove"))
+		case strings.HasSuffix(id, "__up"):
+			stageId := strings.TrimSuffix(id, "__up")
+			jsa.Reorder(stageId, jsa.IndexOf(stageId)-1)
+		case strings.HasSuffix(id, "__down"):
+			stageId := strings.TrimSuffix(id, "__down")
+			jsa.Reorder(stageId, jsa.IndexOf(stageId)+1)
+		default:
+			return nil
+		}
+		getElementById("effects").Set("innerHTML", jsa.RenderEffects())
+		jsa.submitPreviewJob()
+		jsa.persistState()
+		return nil
+	})
+	getElementById("effects").Call("addEventListener", "click", jsa.EffectsClickCallback)
+
+	jsa.ZebraCallback = js.FuncOf(func(this js.Value, args []js.Value) interface{} {
+		ev := args[0]
+		ev.Call("preventDefault")
+		jsa.Zebra = ev.Get("target").Get("checked").Bool()
+		jsa.renderTarget()
+		return nil
+	})
+	getElementById("zebraToggle").Call("addEventListener", "change", jsa.ZebraCallback)
+
 	return jsa
 }
 
+// displayTarget remembers the chain's raw output and renders it, so toggling
+// the zebra overlay afterwards can re-render without recomputing the chain.
+func (jsa *JsApp) displayTarget(img image.Image) {
+	jsa.lastTarget = img
+	jsa.renderTarget()
+}
+
+// renderTarget draws the histogram for the last chain output and pushes it
+// (optionally zebra-tinted) to targetImg. The histogram always reflects the
+// untinted pixels; the tint is a display-only overlay baked in just before
+// encoding.
+func (jsa *JsApp) renderTarget() {
+	if jsa.lastTarget == nil {
+		return
+	}
+	jsa.UpdateHistogram(jsa.Histogram(jsa.lastTarget))
+
+	img := jsa.lastTarget
+	if jsa.Zebra {
+		img = chain.ZebraOverlay(img)
+	}
+	jsa.UpdateImgSrcById("targetImg", img)
+}
+
+// submitPreviewJob hands the current chain to the pipeline under a fresh,
+// monotonically increasing job ID. Any job still in flight for an older ID
+// is discarded by the pipeline rather than racing its result onto targetImg.
+func (jsa *JsApp) submitPreviewJob() {
+	resized := jsa.ResizedImg()
+	if resized == nil {
+		return
+	}
+	id := atomic.AddInt64(&jsa.nextJobID, 1)
+	jsa.pipe.Submit(pipeline.Job{ID: int(id), Img: resized, Stages: jsa.Stages(), Specs: jsa.StageSpecs()})
+}
+
+// submitTiledPreviewJob is the live-drag counterpart of submitPreviewJob: it
+// streams horizontal strips to targetImg as SubmitTiled finishes them via
+// handleTileResult, trading the histogram/zebra overlay (only refreshed by
+// the next submitPreviewJob, on change) for a preview that keeps updating
+// while a slider is still being dragged.
+func (jsa *JsApp) submitTiledPreviewJob() {
+	resized := jsa.ResizedImg()
+	if resized == nil {
+		return
+	}
+	id := atomic.AddInt64(&jsa.nextJobID, 1)
+	jsa.tileJobID = int(id)
+	jsa.tileCanvas = image.NewRGBA(resized.Bounds())
+	jsa.pipe.SubmitTiled(pipeline.Job{ID: int(id), Img: resized, Stages: jsa.Stages(), Specs: jsa.StageSpecs()}, tilePreviewHeight)
+}
+
+// handleTileResult draws a SubmitTiled strip into the job's accumulating
+// tileCanvas at its Y offset and pushes the canvas to targetImg, so the
+// preview fills in progressively instead of waiting for every strip.
+func (jsa *JsApp) handleTileResult(tr pipeline.TileResult) {
+	if jsa.tileCanvas == nil || tr.JobID != jsa.tileJobID {
+		return
+	}
+	bounds := tr.Img.Bounds()
+	dst := image.Rect(0, tr.Y, bounds.Dx(), tr.Y+bounds.Dy())
+	draw.Draw(jsa.tileCanvas, dst, tr.Img, image.Point{}, draw.Src)
+	jsa.UpdateImgSrcById("targetImg", jsa.tileCanvas)
+}
+
+// splitParamId recovers the owning stage Id and param index from a slider's
+// DOM id, rendered by transformationTmpl as "<stageId>__<paramIndex>".
+func splitParamId(id string) (stageId string, paramIndex int, ok bool) {
+	i := strings.LastIndex(id, "__")
+	if i == -1 {
+		return "", 0, false
+	}
+	paramIndex, err := strconv.Atoi(id[i+2:])
+	if err != nil {
+		return "", 0, false
+	}
+	return id[:i], paramIndex, true
+}
+
+// Release tears down every DOM listener registered by NewJsApp, in the same
+// addEventListener/removeEventListener pairing, before releasing the
+// underlying js.Func values; a released js.Func left registered as a
+// listener would panic the next time the DOM fired it.
 func (jsa *JsApp) Release() {
-	// In tip callback.Close() is renamed callback.Release()
-	jsa.ShutdownCallback.Close()
-	jsa.UploadCallback.Close()
-	jsa.AddEffectCallback.Close()
-	jsa.ChangeEffectsCallback.Close()
+	getElementById("shutdownBtn").Call("removeEventListener", "click", jsa.ShutdownCallback)
+	getElementById("uploader").Call("removeEventListener", "change", jsa.UploadCallback)
+	getElementById("addEffectBtn").Call("removeEventListener", "click", jsa.AddEffectCallback)
+	getElementById("effects").Call("removeEventListener", "change", jsa.ChangeEffectsCallback)
+	getElementById("effects").Call("removeEventListener", "input", jsa.EffectsInputCallback)
+	getElementById("effects").Call("removeEventListener", "click", jsa.EffectsClickCallback)
+	getElementById("zebraToggle").Call("removeEventListener", "change", jsa.ZebraCallback)
+
+	jsa.ShutdownCallback.Release()
+	jsa.UploadCallback.Release()
+	jsa.AddEffectCallback.Release()
+	jsa.ChangeEffectsCallback.Release()
+	jsa.EffectsInputCallback.Release()
+	jsa.EffectsClickCallback.Release()
+	jsa.ZebraCallback.Release()
+	jsa.pipe.Close()
+}
+
+// UpdateHistogram draws the R/G/B channel histograms as overlaid line plots
+// into the #histogram canvas.
+func (jsa *JsApp) UpdateHistogram(h chain.Histogram) {
+	canvas := getElementById("histogram")
+	width, height := canvas.Get("width").Int(), canvas.Get("height").Int()
+	ctx := canvas.Call("getContext", "2d")
+	ctx.Call("clearRect", 0, 0, width, height)
+
+	plot := func(bins [256]uint32, color string) {
+		var max uint32
+		for _, v := range bins {
+			if v > max {
+				max = v
+			}
+		}
+		if max == 0 {
+			return
+		}
+		ctx.Set("strokeStyle", color)
+		ctx.Call("beginPath")
+		for x := 0; x < 256; x++ {
+			y := height - int(float64(bins[x])/float64(max)*float64(height))
+			if x == 0 {
+				ctx.Call("moveTo", x, y)
+			} else {
+				ctx.Call("lineTo", x, y)
+			}
+		}
+		ctx.Call("stroke")
+	}
+	plot(h.R, "red")
+	plot(h.G, "green")
+	plot(h.B, "blue")
+}
+
+// UpdateBlurHash stores a BlurHash string on the element's dataset so
+// page-side CSS/JS can decode it into a placeholder the instant it arrives,
+// well before the JPEG round-trip in UpdateImgSrcById completes.
+func (jsa *JsApp) UpdateBlurHash(Id string, hash string) {
+	if hash == "" {
+		return
+	}
+	getElementById(Id).Get("dataset").Set("blurhash", hash)
 }
 
 func (jsa *JsApp) UpdateImgSrcById(Id string, img image.Image) {
@@ -302,6 +396,31 @@ func (jsa *JsApp) UpdateImgSrcById(Id string, img image.Image) {
 	jsa.buf.Reset()
 }
 
+const localStorageKey = "wasmBild.chain"
+
+// readStoredState favors the URL hash, so a shared preset link wins over
+// whatever chain the browser last remembered, and falls back to
+// localStorage so a reload without a hash still restores the chain.
+func readStoredState() string {
+	hash := strings.TrimPrefix(js.Global().Get("location").Get("hash").String(), "#")
+	if hash != "" {
+		return hash
+	}
+	item := js.Global().Get("localStorage").Call("getItem", localStorageKey)
+	if item.IsNull() {
+		return ""
+	}
+	return item.String()
+}
+
+// persistState writes the current chain to both the URL hash and
+// localStorage, so the chain survives a reload and can be shared as a link.
+func (jsa *JsApp) persistState() {
+	state := jsa.MarshalState()
+	js.Global().Get("location").Set("hash", state)
+	js.Global().Get("localStorage").Call("setItem", localStorageKey, state)
+}
+
 func getElementById(Id string) js.Value {
 	return js.Global().Get("document").Call("getElementById", Id)
 }
@@ -0,0 +1,325 @@
+// Package pipeline runs an image through a chain of stages, discarding any
+// job that is superseded by a newer one before it finishes. It backs the
+// WASM UI's live preview: every slider tick submits a new Job, and only the
+// most recently submitted one is ever allowed to reach the DOM.
+//
+// Two Runner implementations are provided. Pipeline runs stages on a small
+// pool of in-process goroutines; under GOOS=js/GOARCH=wasm there is no real
+// OS-thread parallelism, so a Pipeline worker mid-chain on a job still
+// occupies the single UI thread until it yields. WorkerPool (js-only, see
+// workerpool_js.go) instead dispatches each Job to a pool of genuine browser
+// Worker instances over postMessage, so the chain actually runs off the UI
+// thread; NewJsApp falls back to Pipeline if this browser has no Worker
+// constructor.
+//
+// Both implementations check whether a job has been superseded before every
+// stage, not just at the start and end, so a stale job stops as soon as the
+// next stage boundary is reached instead of running to completion; both
+// also support SubmitTiled, which runs the chain over horizontal strips of
+// the image, checking staleness between tiles too, so the caller can stream
+// partial rows to the screen as they complete and a superseded job abandons
+// its remaining tiles.
+//
+// Pipeline checks its own latest field directly, since the worker goroutine
+// running the stages shares memory with the caller. WorkerPool's stage loop
+// instead runs inside a companion Worker (worker_runtime.go), across a
+// postMessage boundary, so Submit and SubmitTiled broadcast a cancel-only
+// WireJob carrying the new latest ID to every worker in the pool, not just
+// the one handed the job itself; each worker keeps its own atomic latest
+// value updated from every WireJob it receives and checks it between stages
+// the same way Pipeline does.
+package pipeline
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"image"
+	"image/draw"
+	"image/png"
+	"sync/atomic"
+)
+
+// Stage is one step of the effect chain. Disabled stages are skipped.
+type Stage struct {
+	Name    string
+	Enabled bool
+	Apply   func(image.Image) image.Image
+}
+
+// StageSpec is the serializable counterpart of Stage: an effect name plus
+// its raw parameter values instead of an Apply closure, small enough to
+// cross a postMessage boundary to a companion Worker, which rebuilds the
+// real Stage from its own copy of the effect catalog (see
+// chain.App.BuildStage). A Job carries both Stages and Specs so either
+// Runner implementation can use whichever shape it needs.
+type StageSpec struct {
+	EffectName string    `json:"effectName"`
+	Values     []float64 `json:"values"`
+	Enabled    bool      `json:"enabled"`
+}
+
+// Job is a single preview request. ID must be monotonically increasing
+// across submissions so the pipeline can tell stale jobs apart from the
+// latest one.
+type Job struct {
+	ID     int
+	Img    image.Image
+	Stages []Stage
+	Specs  []StageSpec
+}
+
+// Result is the output of a Job that was still the latest by the time it
+// finished running.
+type Result struct {
+	ID  int
+	Img image.Image
+}
+
+// TileJob is one horizontal strip of a Job submitted via SubmitTiled. Y is
+// the strip's offset in the source image, for reassembly by the caller.
+type TileJob struct {
+	JobID  int
+	Y      int
+	Img    image.Image
+	Stages []Stage
+}
+
+// TileResult is the output of a TileJob whose Job was still the latest by
+// the time it finished.
+type TileResult struct {
+	JobID int
+	Y     int
+	Img   image.Image
+}
+
+// Runner is the common surface Pipeline and WorkerPool both satisfy, so
+// JsApp can submit preview jobs without caring whether they end up running
+// on in-process goroutines or genuine browser Worker threads.
+type Runner interface {
+	Submit(job Job)
+	SubmitTiled(job Job, tileHeight int)
+	Results() <-chan Result
+	TileResults() <-chan TileResult
+	Close()
+}
+
+// Pipeline is a fixed-size pool of in-process workers applying Jobs' Stages
+// in order. Submit blocks only while the job queue (one slot per worker) is
+// full; results only ever surface for the job whose ID was the latest at
+// completion time, so a caller can submit on every input event without
+// debouncing itself.
+type Pipeline struct {
+	jobs    chan Job
+	results chan Result
+
+	tileJobs    chan TileJob
+	tileResults chan TileResult
+
+	latest int64
+}
+
+// New creates a Pipeline with the given number of worker goroutines,
+// already running.
+func New(workers int) *Pipeline {
+	if workers < 1 {
+		workers = 1
+	}
+	p := &Pipeline{
+		jobs:        make(chan Job, workers),
+		results:     make(chan Result, workers),
+		tileJobs:    make(chan TileJob, workers),
+		tileResults: make(chan TileResult, workers*4),
+	}
+	for i := 0; i < workers; i++ {
+		go p.worker()
+		go p.tileWorker()
+	}
+	return p
+}
+
+func (p *Pipeline) worker() {
+	for job := range p.jobs {
+		img, ok := p.runStages(job.ID, job.Img, job.Stages)
+		if ok {
+			p.results <- Result{ID: job.ID, Img: img}
+		}
+	}
+}
+
+func (p *Pipeline) tileWorker() {
+	for tile := range p.tileJobs {
+		img, ok := p.runStages(tile.JobID, tile.Img, tile.Stages)
+		if ok {
+			p.tileResults <- TileResult{JobID: tile.JobID, Y: tile.Y, Img: img}
+		}
+	}
+}
+
+// runStages applies stages to img in order, bailing out as soon as id is no
+// longer the latest submitted job rather than running the remaining stages.
+// It reports false if id was stale at any point, including on entry.
+func (p *Pipeline) runStages(id int, img image.Image, stages []Stage) (image.Image, bool) {
+	if !p.isLatest(id) {
+		return nil, false
+	}
+	for _, s := range stages {
+		if !p.isLatest(id) {
+			return nil, false
+		}
+		if !s.Enabled {
+			continue
+		}
+		img = s.Apply(img)
+	}
+	return img, p.isLatest(id)
+}
+
+func (p *Pipeline) isLatest(id int) bool {
+	return atomic.LoadInt64(&p.latest) == int64(id)
+}
+
+// Submit enqueues a job and marks it as the latest, invalidating any job
+// still in flight with a smaller ID.
+func (p *Pipeline) Submit(job Job) {
+	atomic.StoreInt64(&p.latest, int64(job.ID))
+	p.jobs <- job
+}
+
+// SubmitTiled splits job's image into horizontal strips of tileHeight rows
+// and enqueues one TileJob per strip, so TileResults can start reaching the
+// caller before the whole image has been processed. Like Submit, it marks
+// job as the latest, invalidating any job in flight with a smaller ID; a
+// job superseded mid-stream abandons whichever tiles have not started yet.
+//
+// Each tile is processed in isolation, so stages that look at neighbouring
+// pixels (blur, median, edge-detection, and friends) see black padding past
+// a tile's edge and can produce visible seams at strip boundaries. That
+// makes SubmitTiled a fit for progressive, responsive-feeling previews
+// during a drag, not for a final, seamless render; JsApp only uses it while
+// a slider is still being dragged, and falls back to Submit on change.
+func (p *Pipeline) SubmitTiled(job Job, tileHeight int) {
+	if tileHeight < 1 {
+		tileHeight = 1
+	}
+	atomic.StoreInt64(&p.latest, int64(job.ID))
+	bounds := job.Img.Bounds()
+	for y := bounds.Min.Y; y < bounds.Max.Y; y += tileHeight {
+		h := tileHeight
+		if y+h > bounds.Max.Y {
+			h = bounds.Max.Y - y
+		}
+		rect := image.Rect(bounds.Min.X, y, bounds.Max.X, y+h)
+		p.tileJobs <- TileJob{JobID: job.ID, Y: y, Img: cropImage(job.Img, rect), Stages: job.Stages}
+	}
+}
+
+// cropImage copies the portion of img inside rect into a new image anchored
+// at (0, 0), since most effect stages assume zero-based bounds.
+func cropImage(img image.Image, rect image.Rectangle) image.Image {
+	out := image.NewRGBA(image.Rect(0, 0, rect.Dx(), rect.Dy()))
+	draw.Draw(out, out.Bounds(), img, rect.Min, draw.Src)
+	return out
+}
+
+// Results returns the channel whole-image results from Submit are delivered
+// on. A result for job N is only ever sent if N was still the latest
+// submitted ID when the worker finished it.
+func (p *Pipeline) Results() <-chan Result {
+	return p.results
+}
+
+// TileResults returns the channel tile results from SubmitTiled are
+// delivered on, in no particular order. A tile result for job N is only
+// ever sent if N was still the latest submitted ID when that tile finished.
+func (p *Pipeline) TileResults() <-chan TileResult {
+	return p.tileResults
+}
+
+// Close stops every worker goroutine by closing the job channels. Safe to
+// call once, when JsApp shuts down.
+func (p *Pipeline) Close() {
+	close(p.jobs)
+	close(p.tileJobs)
+}
+
+// WireJob is the JSON envelope WorkerPool posts to a companion Worker over
+// postMessage, and WireResult the envelope it posts back. Both are plain
+// data so the worker side can decode them with encoding/json alone; images
+// travel as base64 PNG via EncodeImagePNG/DecodeImagePNG.
+//
+// A WireJob with Cancel set carries no work: it only tells the worker that
+// JobID is now the latest submitted job, so a worker running an older job
+// can notice between stages and abandon it, even though that older job was
+// never sent to this particular worker.
+type WireJob struct {
+	JobID  int         `json:"jobId"`
+	Tile   bool        `json:"tile"`
+	Y      int         `json:"y"`
+	PNG    string      `json:"png"`
+	Stages []StageSpec `json:"stages"`
+	Cancel bool        `json:"cancel"`
+}
+
+// Encode marshals j to JSON, returning "" on the (unexpected) failure case
+// so callers posting to a Worker don't need to thread an error through.
+func (j WireJob) Encode() string {
+	data, err := json.Marshal(j)
+	if err != nil {
+		return ""
+	}
+	return string(data)
+}
+
+// DecodeWireJob parses a WireJob posted by WorkerPool.
+func DecodeWireJob(s string) (WireJob, error) {
+	var j WireJob
+	err := json.Unmarshal([]byte(s), &j)
+	return j, err
+}
+
+// WireResult is the postMessage reply to a WireJob.
+type WireResult struct {
+	JobID int    `json:"jobId"`
+	Tile  bool   `json:"tile"`
+	Y     int    `json:"y"`
+	PNG   string `json:"png"`
+}
+
+// Encode marshals r to JSON, returning "" on the (unexpected) failure case
+// so callers posting from the worker don't need to thread an error through.
+func (r WireResult) Encode() string {
+	data, err := json.Marshal(r)
+	if err != nil {
+		return ""
+	}
+	return string(data)
+}
+
+// DecodeWireResult parses a WireResult posted back by a companion Worker.
+func DecodeWireResult(s string) (WireResult, error) {
+	var r WireResult
+	err := json.Unmarshal([]byte(s), &r)
+	return r, err
+}
+
+// EncodeImagePNG base64-encodes img as a PNG, the format WireJob and
+// WireResult use to cross the postMessage boundary; PNG, not the JPEG the
+// UI otherwise prefers for display, keeps intermediate pipeline stages
+// lossless.
+func EncodeImagePNG(img image.Image) (string, error) {
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(buf.Bytes()), nil
+}
+
+// DecodeImagePNG reverses EncodeImagePNG.
+func DecodeImagePNG(s string) (image.Image, error) {
+	data, err := base64.StdEncoding.DecodeString(s)
+	if err != nil {
+		return nil, err
+	}
+	return png.Decode(bytes.NewReader(data))
+}
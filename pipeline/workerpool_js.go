@@ -0,0 +1,159 @@
+//go:build js
+
+package pipeline
+
+import (
+	"errors"
+	"image"
+	"sync/atomic"
+	"syscall/js"
+)
+
+// WorkerPool dispatches Jobs to a fixed-size pool of real browser Worker
+// instances, each running its own copy of this same wasm binary in worker
+// mode (see main's isWorkerContext and runWorkerMode), so heavy chain work
+// actually leaves the UI thread instead of merely cooperating with it like
+// Pipeline does. Jobs and results cross the postMessage boundary as
+// WireJob/WireResult JSON strings, with images carried as base64 PNG.
+type WorkerPool struct {
+	workers []js.Value
+	next    uint64
+
+	results     chan Result
+	tileResults chan TileResult
+
+	latest int64
+}
+
+// NewWorkerPool spawns n Workers from scriptURL, each expected to load the
+// same wasm binary this pool itself is running in (see worker.js). It
+// reports an error if this browser has no Worker constructor, so callers
+// can fall back to New's in-process Pipeline instead.
+func NewWorkerPool(n int, scriptURL string) (*WorkerPool, error) {
+	ctor := js.Global().Get("Worker")
+	if !ctor.Truthy() {
+		return nil, errors.New("pipeline: this browser has no Worker constructor")
+	}
+	if n < 1 {
+		n = 1
+	}
+	wp := &WorkerPool{
+		workers:     make([]js.Value, n),
+		results:     make(chan Result, n),
+		tileResults: make(chan TileResult, n*4),
+	}
+	for i := range wp.workers {
+		w := ctor.New(scriptURL)
+		w.Call("addEventListener", "message", js.FuncOf(wp.onMessage))
+		wp.workers[i] = w
+	}
+	return wp, nil
+}
+
+func (wp *WorkerPool) onMessage(this js.Value, args []js.Value) interface{} {
+	res, err := DecodeWireResult(args[0].Get("data").String())
+	if err != nil || !wp.isLatest(res.JobID) {
+		return nil
+	}
+	img, err := DecodeImagePNG(res.PNG)
+	if err != nil {
+		return nil
+	}
+	if res.Tile {
+		select {
+		case wp.tileResults <- TileResult{JobID: res.JobID, Y: res.Y, Img: img}:
+		default:
+		}
+		return nil
+	}
+	select {
+	case wp.results <- Result{ID: res.JobID, Img: img}:
+	default:
+	}
+	return nil
+}
+
+func (wp *WorkerPool) isLatest(id int) bool {
+	return atomic.LoadInt64(&wp.latest) == int64(id)
+}
+
+// nextWorker round-robins across the pool so submissions spread across
+// workers instead of always hitting the first one.
+func (wp *WorkerPool) nextWorker() js.Value {
+	i := atomic.AddUint64(&wp.next, 1)
+	return wp.workers[int(i)%len(wp.workers)]
+}
+
+// broadcastLatest tells every worker in the pool that id is now the latest
+// submitted job, including workers that are never handed any of its work,
+// so a worker still mid-chain on an older job can notice it has been
+// superseded between stages instead of only losing the race once it posts
+// a now-stale result back (see onMessage's isLatest check).
+func (wp *WorkerPool) broadcastLatest(id int) {
+	msg := WireJob{JobID: id, Cancel: true}.Encode()
+	for _, w := range wp.workers {
+		w.Call("postMessage", msg)
+	}
+}
+
+// Submit posts job to the next worker in round-robin order as a single
+// whole-image WireJob, marking it the latest so onMessage drops a result
+// for a smaller ID instead of racing it onto Results.
+func (wp *WorkerPool) Submit(job Job) {
+	atomic.StoreInt64(&wp.latest, int64(job.ID))
+	wp.broadcastLatest(job.ID)
+	png, err := EncodeImagePNG(job.Img)
+	if err != nil {
+		return
+	}
+	wp.nextWorker().Call("postMessage", WireJob{JobID: job.ID, PNG: png, Stages: job.Specs}.Encode())
+}
+
+// SubmitTiled splits job's image into horizontal strips of tileHeight rows
+// and posts one tile WireJob per strip, round-robining across the pool so
+// tiles of the same job can be processed by several workers concurrently.
+// Like Submit, it marks job as the latest, invalidating any job in flight
+// with a smaller ID.
+func (wp *WorkerPool) SubmitTiled(job Job, tileHeight int) {
+	if tileHeight < 1 {
+		tileHeight = 1
+	}
+	atomic.StoreInt64(&wp.latest, int64(job.ID))
+	wp.broadcastLatest(job.ID)
+	bounds := job.Img.Bounds()
+	for y := bounds.Min.Y; y < bounds.Max.Y; y += tileHeight {
+		h := tileHeight
+		if y+h > bounds.Max.Y {
+			h = bounds.Max.Y - y
+		}
+		rect := image.Rect(bounds.Min.X, y, bounds.Max.X, y+h)
+		png, err := EncodeImagePNG(cropImage(job.Img, rect))
+		if err != nil {
+			continue
+		}
+		wp.nextWorker().Call("postMessage", WireJob{JobID: job.ID, Tile: true, Y: y, PNG: png, Stages: job.Specs}.Encode())
+	}
+}
+
+// Results returns the channel whole-image results from Submit are delivered
+// on. A result for job N is only ever sent if N was still the latest
+// submitted ID when its worker replied.
+func (wp *WorkerPool) Results() <-chan Result {
+	return wp.results
+}
+
+// TileResults returns the channel tile results from SubmitTiled are
+// delivered on, in no particular order. A tile result for job N is only
+// ever sent if N was still the latest submitted ID when that tile's worker
+// replied.
+func (wp *WorkerPool) TileResults() <-chan TileResult {
+	return wp.tileResults
+}
+
+// Close terminates every worker in the pool. Safe to call once, when JsApp
+// shuts down.
+func (wp *WorkerPool) Close() {
+	for _, w := range wp.workers {
+		w.Call("terminate")
+	}
+}
@@ -0,0 +1,81 @@
+//go:build js
+
+package main
+
+import (
+	"sync/atomic"
+	"syscall/js"
+
+	"github.com/yml/wasmBild/chain"
+	"github.com/yml/wasmBild/pipeline"
+)
+
+// isWorkerContext reports whether this wasm binary is running inside the
+// companion Worker loaded by worker.js rather than the main document:
+// importScripts only exists in a Worker/ServiceWorker global scope.
+func isWorkerContext() bool {
+	return js.Global().Get("importScripts").Truthy()
+}
+
+// latestJobID mirrors WorkerPool.latest inside this Worker. Every WireJob
+// this Worker receives updates it, including cancel-only broadcasts for
+// jobs handed to a different worker in the pool, so handleWireJob can tell
+// its own job has been superseded between stages even though the job that
+// superseded it was never posted here.
+var latestJobID int64
+
+// runWorkerMode is main's entry point when isWorkerContext is true. There
+// is no DOM to render a JsApp into here, so instead it registers an
+// onmessage handler that decodes each pipeline.WireJob posted by a
+// pipeline.WorkerPool, runs it through a throwaway chain.App's effect
+// catalog, and posts a pipeline.WireResult back.
+func runWorkerMode() {
+	app := chain.NewApp()
+	js.Global().Set("onmessage", js.FuncOf(func(this js.Value, args []js.Value) interface{} {
+		job, err := pipeline.DecodeWireJob(args[0].Get("data").String())
+		if err != nil {
+			log(err.Error())
+			return nil
+		}
+		atomic.StoreInt64(&latestJobID, int64(job.JobID))
+		if job.Cancel {
+			return nil
+		}
+		go handleWireJob(app, job)
+		return nil
+	}))
+}
+
+// handleWireJob applies job's stages in order, bailing out as soon as
+// latestJobID no longer matches job.JobID rather than running the
+// remaining stages, mirroring Pipeline.runStages on the in-process Runner.
+func handleWireJob(app *chain.App, job pipeline.WireJob) {
+	img, err := pipeline.DecodeImagePNG(job.PNG)
+	if err != nil {
+		log(err.Error())
+		return
+	}
+	for _, spec := range job.Stages {
+		if atomic.LoadInt64(&latestJobID) != int64(job.JobID) {
+			return
+		}
+		if !spec.Enabled {
+			continue
+		}
+		stage, ok := app.BuildStage(spec)
+		if !ok {
+			continue
+		}
+		img = stage.Apply(img)
+	}
+	if atomic.LoadInt64(&latestJobID) != int64(job.JobID) {
+		return
+	}
+	png, err := pipeline.EncodeImagePNG(img)
+	if err != nil {
+		log(err.Error())
+		return
+	}
+	reply := pipeline.WireResult{JobID: job.JobID, Tile: job.Tile, Y: job.Y, PNG: png}
+	js.Global().Call("postMessage", reply.Encode())
+}